@@ -0,0 +1,356 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/mtail/metrics"
+)
+
+// Pos describes the source position of a node, in line:column form, with
+// lines and columns both 1-indexed to match the lexer's error reporting.
+type Pos struct {
+	Line   int
+	Column int
+}
+
+func (p Pos) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+// CommentGroup is a run of one or more comment lines immediately preceding,
+// or trailing, a node. The lexer and parser do not record these; the caller
+// passes them to NewPrinter, which reattaches them to their owning node so
+// that re-emitted programs keep the author's comments.
+// Pos is the position of the first comment line, which Printer compares
+// against the owning node's own position to tell a leading comment (Pos.Line
+// before the node's) from a trailing one on the same line.
+type CommentGroup struct {
+	Pos      Pos
+	Comments []string
+}
+
+// Dumper renders a syntax tree as an S-expression, in the style of
+// go/ast.Print, for debugging the parser and compiler. Unlike Unparser it
+// does not try to produce valid mtail program text; it exists purely to make
+// the shape of a tree visible. Node types themselves carry no Pos field, so
+// positions are supplied out of band, as a map[node]Pos keyed by node
+// identity and passed to NewDumper. The parser does not build such a map.
+type Dumper struct {
+	positions map[node]Pos
+}
+
+// NewDumper returns a Dumper that annotates each node in its output with the
+// source position recorded for it, if any. A zero-value Dumper{} dumps
+// without positions.
+func NewDumper(positions map[node]Pos) *Dumper {
+	return &Dumper{positions: positions}
+}
+
+func (d *Dumper) dump(n node) string {
+	if n == nil {
+		return "nil"
+	}
+	body := d.dumpBody(n)
+	if pos, ok := d.positions[n]; ok {
+		return withPos(body, pos)
+	}
+	return body
+}
+
+// withPos inserts a trailing `@line:col` field into a dumped S-expression,
+// e.g. "(idNode Name=x)" becomes "(idNode Name=x @3:8)".
+func withPos(body string, pos Pos) string {
+	if !strings.HasSuffix(body, ")") {
+		return body
+	}
+	return body[:len(body)-1] + " @" + pos.String() + ")"
+}
+
+func (d *Dumper) dumpBody(n node) string {
+	switch v := n.(type) {
+	case *stmtlistNode:
+		return d.wrap("stmtlistNode", d.dumpList(v.children))
+
+	case *exprlistNode:
+		return d.wrap("exprlistNode", d.dumpList(v.children))
+
+	case *condNode:
+		return d.wrap(fmt.Sprintf("condNode Cond=%s Filter=%s", d.dumpOpt(v.cond), d.dumpOpt(v.filter)), d.dumpList(v.children))
+
+	case *regexNode:
+		return fmt.Sprintf("(regexNode Pattern=%q)", v.pattern)
+
+	case *binaryExprNode:
+		return fmt.Sprintf("(binaryExprNode Op=%s X=%s Y=%s)", opString(v.op), d.dump(v.lhs), d.dump(v.rhs))
+
+	case *unaryExprNode:
+		return fmt.Sprintf("(unaryExprNode Op=%s X=%s)", opString(v.op), d.dump(v.lhs))
+
+	case *stringNode:
+		return fmt.Sprintf("(stringNode Text=%q)", v.text)
+
+	case *idNode:
+		return fmt.Sprintf("(idNode Name=%s)", v.name)
+
+	case *caprefNode:
+		return fmt.Sprintf("(caprefNode Name=%s)", v.name)
+
+	case *builtinNode:
+		return fmt.Sprintf("(builtinNode Name=%s Args=%s)", v.name, d.dumpOpt(v.args))
+
+	case *indexedExprNode:
+		return fmt.Sprintf("(indexedExprNode X=%s Index=%s)", d.dump(v.lhs), d.dump(v.index))
+
+	case *declNode:
+		return fmt.Sprintf("(declNode Kind=%s Name=%s Keys=%v)", metricKindString(v.kind), v.name, v.keys)
+
+	case *numericExprNode:
+		return fmt.Sprintf("(numericExprNode Value=%d)", v.value)
+
+	case *defNode:
+		return d.wrap(fmt.Sprintf("defNode Name=%s", v.name), d.dumpList(v.children))
+
+	case *decoNode:
+		return d.wrap(fmt.Sprintf("decoNode Name=%s Filter=%s", v.name, d.dumpOpt(v.filter)), d.dumpList(v.children))
+
+	case *nextNode:
+		return "(nextNode)"
+
+	case *funcNode:
+		return d.wrap(fmt.Sprintf("funcNode Name=%s Params=%v", v.name, v.params), d.dumpList(v.body.children))
+
+	case *callNode:
+		return fmt.Sprintf("(callNode Name=%s Args=%s)", v.name, d.dumpOpt(v.args))
+
+	case *filterExprNode:
+		if v.op == IN_OP && v.rhs == nil {
+			return fmt.Sprintf("(filterExprNode Op=in X=%s Set=%s)", d.dump(v.lhs), d.dumpList(v.set))
+		}
+		return fmt.Sprintf("(filterExprNode Op=%s X=%s Y=%s)", v.op, d.dumpOpt(v.lhs), d.dumpOpt(v.rhs))
+
+	default:
+		return fmt.Sprintf("(%T <unknown>)", n)
+	}
+}
+
+func (d *Dumper) dumpOpt(n node) string {
+	if n == nil {
+		return "nil"
+	}
+	return d.dump(n)
+}
+
+func (d *Dumper) dumpList(children []node) string {
+	parts := make([]string, 0, len(children))
+	for _, c := range children {
+		parts = append(parts, d.dump(c))
+	}
+	return strings.Join(parts, " ")
+}
+
+func (d *Dumper) wrap(head, body string) string {
+	if body == "" {
+		return fmt.Sprintf("(%s)", head)
+	}
+	return fmt.Sprintf("(%s %s)", head, body)
+}
+
+// Dump renders n as a structured S-expression for debugging.
+func (d *Dumper) Dump(n node) string {
+	return d.dump(n)
+}
+
+func metricKindString(k metrics.Kind) string {
+	switch k {
+	case metrics.Counter:
+		return "Counter"
+	case metrics.Gauge:
+		return "Gauge"
+	case metrics.Timer:
+		return "Timer"
+	}
+	return "Unknown"
+}
+
+func opString(op int) string {
+	switch op {
+	case LT:
+		return "<"
+	case GT:
+		return ">"
+	case LE:
+		return "<="
+	case GE:
+		return ">="
+	case EQ:
+		return "=="
+	case NE:
+		return "!="
+	case SHL:
+		return "<<"
+	case SHR:
+		return ">>"
+	case AND:
+		return "&"
+	case OR:
+		return "|"
+	case XOR:
+		return "^"
+	case NOT:
+		return "~"
+	case POW:
+		return "**"
+	case ASSIGN:
+		return "="
+	case ADD_ASSIGN:
+		return "+="
+	case INC:
+		return "++"
+	case POSTDEC:
+		return "--"
+	case '+', '-', '*', '/':
+		return string(rune(op))
+	}
+	return fmt.Sprintf("op(%d)", op)
+}
+
+// maxLineLength is the column at which Printer starts wrapping long
+// exprlistNode and binaryExprNode chains onto continuation lines, rather than
+// emitting them as a single unbroken line the way Unparser does.
+const maxLineLength = 80
+
+// Printer is a canonical, position-preserving pretty-printer. It re-emits a
+// program from its syntax tree, restoring the original comments recorded
+// alongside each node, preserving blank lines between top-level statements,
+// and wrapping long expressions instead of emitting them on one line. Where
+// Unparser produces a minimal, compact rendering suitable for round-tripping
+// through the parser, Printer aims to reproduce what the author wrote.
+//
+// Like Dumper, Printer takes its position and comment data out of band, as
+// map[node]Pos and map[node]*CommentGroup supplied by the caller, rather than
+// as fields on the node types themselves. The parser does not build these
+// maps.
+type Printer struct {
+	Unparser
+	comments  map[node]*CommentGroup
+	positions map[node]Pos
+	lastLine  int
+}
+
+// NewPrinter returns a Printer that attaches the given comments and
+// positions to the nodes they are keyed by. It wires
+// Unparser.recurse back to the Printer's own print method, so that every
+// nested node encountered during printing gets its comments and blank lines
+// applied, not just the node Print is first called with.
+func NewPrinter(comments map[node]*CommentGroup, positions map[node]Pos) *Printer {
+	p := &Printer{comments: comments, positions: positions}
+	p.Unparser.recurse = p.print
+	return p
+}
+
+// emitBlankLine reproduces a blank line that appeared before n in the
+// source, if n's recorded position is more than one line past the last node
+// Printer emitted.
+func (p *Printer) emitBlankLine(n node) {
+	pos, ok := p.positions[n]
+	if !ok {
+		return
+	}
+	if p.lastLine != 0 && pos.Line > p.lastLine+1 {
+		p.newline()
+	}
+	p.lastLine = pos.Line
+}
+
+// emitComments emits the comment lines recorded for n that precede it in
+// the source (cg.Pos.Line before n's own line); same-line trailing comments
+// are left to printTrailingComment, called after n itself is printed.
+func (p *Printer) emitComments(n node) {
+	cg, ok := p.comments[n]
+	if !ok {
+		return
+	}
+	nodePos, hasPos := p.positions[n]
+	if hasPos && cg.Pos.Line >= nodePos.Line {
+		return
+	}
+	for _, c := range cg.Comments {
+		p.emit("# " + c)
+		p.newline()
+	}
+}
+
+func (p *Printer) printTrailingComment(n node) {
+	cg, ok := p.comments[n]
+	if !ok {
+		return
+	}
+	nodePos, hasPos := p.positions[n]
+	if !hasPos || cg.Pos.Line != nodePos.Line {
+		return
+	}
+	for _, c := range cg.Comments {
+		p.emit(" # " + c)
+	}
+}
+
+// print renders n, applying n's own blank-line and comment handling, then
+// dispatches to unparse for the actual node text. Because NewPrinter wires
+// Unparser.recurse to print, every child node unparse descends into -
+// statements in a block, operands of an expression, and so on - comes back
+// through print too, so comments and blank lines are preserved at every
+// depth, not just at the root.
+func (p *Printer) print(n node) {
+	if n == nil {
+		return
+	}
+	p.emitBlankLine(n)
+	p.emitComments(n)
+	switch v := n.(type) {
+	case *exprlistNode:
+		p.printWrapped(v.children)
+	case *binaryExprNode:
+		p.visit(v.lhs)
+		p.emit(" " + opString(v.op))
+		if p.pos+len(p.line) > maxLineLength {
+			p.newline()
+			p.emit("  ")
+		} else {
+			p.emit(" ")
+		}
+		p.visit(v.rhs)
+	default:
+		p.unparse(n)
+	}
+	p.printTrailingComment(n)
+}
+
+// Print begins printing the syntax tree, returning formatted program text
+// with comments and position-derived line breaks restored.
+func (p *Printer) Print(n node) string {
+	p.print(n)
+	return p.output
+}
+
+// printWrapped emits a comma-separated list of expressions, breaking onto a
+// continuation line once the current line has passed maxLineLength. Each
+// continuation line is indented two spaces past the current indent, not per
+// element, so elements don't indent further with each wrap.
+func (p *Printer) printWrapped(children []node) {
+	for i, child := range children {
+		if i > 0 {
+			p.emit(",")
+			if p.pos+len(p.line) > maxLineLength {
+				p.newline()
+				p.emit("  ")
+			} else {
+				p.emit(" ")
+			}
+		}
+		p.visit(child)
+	}
+}
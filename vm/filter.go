@@ -0,0 +1,397 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// filterExprNode is the root of a small boolean expression language that can
+// be attached to a condNode or decoNode to gate whether its children run,
+// e.g.:
+//
+//	@syslog { $severity in ["err", "crit"] && count("errors") > 100 { ... } }
+//
+// It is evaluated at runtime against the current match's captures and the
+// existing metric store, rather than compiled to VM bytecode directly; see
+// filterOp for the operators it supports.
+type filterExprNode struct {
+	op  filterOp
+	lhs node
+	rhs node
+	// set holds the element list for an IN_OP membership test, where rhs is
+	// unused.
+	set []node
+}
+
+// filterOp enumerates the operators understood by the filter expression
+// parser. It is distinct from the token constants used by the main
+// expression grammar (LT, GT, AND, OR, ...) because membership and
+// short-circuit boolean evaluation have no equivalent there.
+type filterOp int
+
+const (
+	// IN_OP tests set membership: lhs in set.
+	IN_OP filterOp = iota
+	// ANDAND_OP and OROR_OP are short-circuiting boolean and/or, as opposed
+	// to the bitwise AND/OR token constants used elsewhere in the grammar.
+	ANDAND_OP
+	OROR_OP
+	NOT_OP
+	LT_OP
+	GT_OP
+	LE_OP
+	GE_OP
+	EQ_OP
+	NE_OP
+)
+
+func (op filterOp) String() string {
+	switch op {
+	case IN_OP:
+		return "in"
+	case ANDAND_OP:
+		return "&&"
+	case OROR_OP:
+		return "||"
+	case NOT_OP:
+		return "!"
+	case LT_OP:
+		return "<"
+	case GT_OP:
+		return ">"
+	case LE_OP:
+		return "<="
+	case GE_OP:
+		return ">="
+	case EQ_OP:
+		return "=="
+	case NE_OP:
+		return "!="
+	}
+	return "?"
+}
+
+// filterToken is one lexical token of the filter expression language.
+type filterToken struct {
+	kind filterTokenKind
+	text string
+}
+
+type filterTokenKind int
+
+const (
+	filterEOF filterTokenKind = iota
+	filterIdent
+	filterCapref
+	filterNumber
+	filterString
+	filterLBracket
+	filterRBracket
+	filterComma
+	filterLParen
+	filterRParen
+	filterOpTok
+)
+
+// filterLexer tokenizes a filter expression. It is intentionally much
+// simpler than the main mtail lexer: the filter language has no statements,
+// blocks or regexes, only the small set of tokens needed for comparisons,
+// membership and boolean combinators.
+type filterLexer struct {
+	input string
+	pos   int
+}
+
+func (l *filterLexer) peek() byte {
+	if l.pos >= len(l.input) {
+		return 0
+	}
+	return l.input[l.pos]
+}
+
+func (l *filterLexer) next() filterToken {
+	for l.pos < len(l.input) && (l.input[l.pos] == ' ' || l.input[l.pos] == '\t') {
+		l.pos++
+	}
+	if l.pos >= len(l.input) {
+		return filterToken{kind: filterEOF}
+	}
+	c := l.input[l.pos]
+	switch {
+	case c == '[':
+		l.pos++
+		return filterToken{kind: filterLBracket, text: "["}
+	case c == ']':
+		l.pos++
+		return filterToken{kind: filterRBracket, text: "]"}
+	case c == ',':
+		l.pos++
+		return filterToken{kind: filterComma, text: ","}
+	case c == '(':
+		l.pos++
+		return filterToken{kind: filterLParen, text: "("}
+	case c == ')':
+		l.pos++
+		return filterToken{kind: filterRParen, text: ")"}
+	case c == '$':
+		start := l.pos
+		l.pos++
+		for l.pos < len(l.input) && isIdentByte(l.input[l.pos]) {
+			l.pos++
+		}
+		return filterToken{kind: filterCapref, text: l.input[start+1 : l.pos]}
+	case c == '"':
+		start := l.pos + 1
+		l.pos++
+		for l.pos < len(l.input) && l.input[l.pos] != '"' {
+			l.pos++
+		}
+		text := l.input[start:l.pos]
+		l.pos++ // closing quote
+		return filterToken{kind: filterString, text: text}
+	case c == '&' && l.peek2() == '&':
+		l.pos += 2
+		return filterToken{kind: filterOpTok, text: "&&"}
+	case c == '|' && l.peek2() == '|':
+		l.pos += 2
+		return filterToken{kind: filterOpTok, text: "||"}
+	case c == '=' && l.peek2() == '=':
+		l.pos += 2
+		return filterToken{kind: filterOpTok, text: "=="}
+	case c == '!' && l.peek2() == '=':
+		l.pos += 2
+		return filterToken{kind: filterOpTok, text: "!="}
+	case c == '<' && l.peek2() == '=':
+		l.pos += 2
+		return filterToken{kind: filterOpTok, text: "<="}
+	case c == '>' && l.peek2() == '=':
+		l.pos += 2
+		return filterToken{kind: filterOpTok, text: ">="}
+	case c == '<' || c == '>' || c == '!':
+		l.pos++
+		return filterToken{kind: filterOpTok, text: string(c)}
+	case c >= '0' && c <= '9':
+		start := l.pos
+		for l.pos < len(l.input) && l.input[l.pos] >= '0' && l.input[l.pos] <= '9' {
+			l.pos++
+		}
+		return filterToken{kind: filterNumber, text: l.input[start:l.pos]}
+	case isIdentByte(c):
+		start := l.pos
+		for l.pos < len(l.input) && isIdentByte(l.input[l.pos]) {
+			l.pos++
+		}
+		return filterToken{kind: filterIdent, text: l.input[start:l.pos]}
+	}
+	l.pos++
+	return filterToken{kind: filterOpTok, text: string(c)}
+}
+
+func (l *filterLexer) peek2() byte {
+	if l.pos+1 >= len(l.input) {
+		return 0
+	}
+	return l.input[l.pos+1]
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// filterPrec gives each binary operator's binding power, lowest first, for
+// the Pratt parser below: || binds loosest, then &&, then the comparisons
+// and "in".
+var filterPrec = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"in": 3,
+	"==": 3, "!=": 3, "<": 3, ">": 3, "<=": 3, ">=": 3,
+}
+
+// filterParser is a small Pratt parser that turns filter expression text
+// into a tree of filterExprNode, leaning on idNode, caprefNode, stringNode,
+// numericExprNode and builtinNode for its leaves so it composes with the
+// rest of the AST and with Unparser/Dumper without new leaf types.
+type filterParser struct {
+	lex *filterLexer
+	tok filterToken
+}
+
+// parseFilterExpr parses s as a filterExprNode, for attaching to a condNode
+// or decoNode's filter.
+func parseFilterExpr(s string) (*filterExprNode, error) {
+	p := &filterParser{lex: &filterLexer{input: s}}
+	p.advance()
+	n, err := p.parseExpr(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != filterEOF {
+		return nil, fmt.Errorf("filter expression: unexpected trailing token %q", p.tok.text)
+	}
+	fe, ok := n.(*filterExprNode)
+	if !ok {
+		return nil, fmt.Errorf("filter expression: expected boolean expression, got %T", n)
+	}
+	return fe, nil
+}
+
+func (p *filterParser) advance() {
+	p.tok = p.lex.next()
+}
+
+func (p *filterParser) parseExpr(minPrec int) (node, error) {
+	lhs, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		opText, prec, ok := p.peekOperator()
+		if !ok || prec < minPrec {
+			return lhs, nil
+		}
+		p.advance()
+		if opText == "in" {
+			set, err := p.parseSet()
+			if err != nil {
+				return nil, err
+			}
+			lhs = &filterExprNode{op: IN_OP, lhs: lhs, set: set}
+			continue
+		}
+		rhs, err := p.parseExpr(prec + 1)
+		if err != nil {
+			return nil, err
+		}
+		lhs = &filterExprNode{op: filterOpFor(opText), lhs: lhs, rhs: rhs}
+	}
+}
+
+func (p *filterParser) peekOperator() (string, int, bool) {
+	var text string
+	switch p.tok.kind {
+	case filterOpTok:
+		text = p.tok.text
+	case filterIdent:
+		if p.tok.text == "in" {
+			text = "in"
+		}
+	default:
+		return "", 0, false
+	}
+	prec, ok := filterPrec[text]
+	return text, prec, ok
+}
+
+func (p *filterParser) parseSet() ([]node, error) {
+	if p.tok.kind != filterLBracket {
+		return nil, fmt.Errorf("filter expression: expected '[' to start a set, got %q", p.tok.text)
+	}
+	p.advance()
+	var elems []node
+	for p.tok.kind != filterRBracket {
+		if p.tok.kind == filterEOF {
+			return nil, fmt.Errorf("filter expression: unterminated set literal")
+		}
+		elem, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, elem)
+		if p.tok.kind == filterComma {
+			p.advance()
+		}
+	}
+	p.advance() // consume ']'
+	return elems, nil
+}
+
+func (p *filterParser) parsePrimary() (node, error) {
+	switch p.tok.kind {
+	case filterCapref:
+		n := &caprefNode{name: p.tok.text}
+		p.advance()
+		return n, nil
+	case filterIdent:
+		name := p.tok.text
+		p.advance()
+		if p.tok.kind == filterLParen {
+			p.advance()
+			var args []node
+			for p.tok.kind != filterRParen {
+				arg, err := p.parseExpr(0)
+				if err != nil {
+					return nil, err
+				}
+				args = append(args, arg)
+				if p.tok.kind == filterComma {
+					p.advance()
+				}
+			}
+			p.advance() // consume ')'
+			return &builtinNode{name: name, args: &exprlistNode{children: args}}, nil
+		}
+		return &idNode{name: name}, nil
+	case filterString:
+		n := &stringNode{text: p.tok.text}
+		p.advance()
+		return n, nil
+	case filterNumber:
+		v, err := strconv.ParseInt(p.tok.text, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("filter expression: bad number %q: %s", p.tok.text, err)
+		}
+		p.advance()
+		return &numericExprNode{value: v}, nil
+	case filterOpTok:
+		if p.tok.text == "!" {
+			p.advance()
+			operand, err := p.parsePrimary()
+			if err != nil {
+				return nil, err
+			}
+			return &filterExprNode{op: NOT_OP, lhs: operand}, nil
+		}
+	case filterLParen:
+		p.advance()
+		n, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		if p.tok.kind != filterRParen {
+			return nil, fmt.Errorf("filter expression: expected ')', got %q", p.tok.text)
+		}
+		p.advance()
+		return n, nil
+	}
+	return nil, fmt.Errorf("filter expression: unexpected token %q", p.tok.text)
+}
+
+func filterOpFor(text string) filterOp {
+	switch text {
+	case "in":
+		return IN_OP
+	case "&&":
+		return ANDAND_OP
+	case "||":
+		return OROR_OP
+	case "!":
+		return NOT_OP
+	case "<":
+		return LT_OP
+	case ">":
+		return GT_OP
+	case "<=":
+		return LE_OP
+	case ">=":
+		return GE_OP
+	case "==":
+		return EQ_OP
+	case "!=":
+		return NE_OP
+	}
+	return ANDAND_OP
+}
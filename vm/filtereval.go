@@ -0,0 +1,162 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import "strconv"
+
+// filterEnv is the runtime context a filterExprNode is evaluated against: the
+// capture groups of the match that triggered the enclosing condNode or
+// decoNode, and a lookup function for metric values, so that filters can
+// reference both `$capture` values and existing metrics such as
+// `count("errors")`. metricValue is expected to be backed by the program's
+// metric store, keyed by metric name.
+type filterEnv struct {
+	captures    map[string]string
+	metricValue func(name string) (int64, bool)
+}
+
+// evalFilter evaluates a filterExprNode tree against env, implementing
+// short-circuit && and || and IN_OP set membership directly in Go rather
+// than compiling to VM bytecode; this mirrors how the VM already
+// tree-walks condNode guards before falling into its bytecode body. A
+// bytecode-based implementation would instead lower this to new JNZ/JZ-style
+// short-circuit jumps and a MEMBER opcode alongside the existing comparison
+// opcodes.
+func evalFilter(n *filterExprNode, env *filterEnv) (bool, error) {
+	switch n.op {
+	case ANDAND_OP:
+		lhs, err := evalFilterOperand(n.lhs, env)
+		if err != nil {
+			return false, err
+		}
+		if !truthy(lhs) {
+			return false, nil
+		}
+		rhs, err := evalFilterOperand(n.rhs, env)
+		if err != nil {
+			return false, err
+		}
+		return truthy(rhs), nil
+
+	case OROR_OP:
+		lhs, err := evalFilterOperand(n.lhs, env)
+		if err != nil {
+			return false, err
+		}
+		if truthy(lhs) {
+			return true, nil
+		}
+		rhs, err := evalFilterOperand(n.rhs, env)
+		if err != nil {
+			return false, err
+		}
+		return truthy(rhs), nil
+
+	case NOT_OP:
+		lhs, err := evalFilterOperand(n.lhs, env)
+		if err != nil {
+			return false, err
+		}
+		return !truthy(lhs), nil
+
+	case IN_OP:
+		lhs, err := evalFilterOperand(n.lhs, env)
+		if err != nil {
+			return false, err
+		}
+		for _, e := range n.set {
+			rhs, err := evalFilterOperand(e, env)
+			if err != nil {
+				return false, err
+			}
+			if lhs == rhs {
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case LT_OP, GT_OP, LE_OP, GE_OP, EQ_OP, NE_OP:
+		return evalFilterComparison(n, env)
+	}
+	return false, nil
+}
+
+func evalFilterComparison(n *filterExprNode, env *filterEnv) (bool, error) {
+	lhs, err := evalFilterOperand(n.lhs, env)
+	if err != nil {
+		return false, err
+	}
+	rhs, err := evalFilterOperand(n.rhs, env)
+	if err != nil {
+		return false, err
+	}
+	switch n.op {
+	case EQ_OP:
+		return lhs == rhs, nil
+	case NE_OP:
+		return lhs != rhs, nil
+	}
+	lf, lerr := strconv.ParseFloat(lhs, 64)
+	rf, rerr := strconv.ParseFloat(rhs, 64)
+	if lerr != nil || rerr != nil {
+		return false, nil
+	}
+	switch n.op {
+	case LT_OP:
+		return lf < rf, nil
+	case GT_OP:
+		return lf > rf, nil
+	case LE_OP:
+		return lf <= rf, nil
+	case GE_OP:
+		return lf >= rf, nil
+	}
+	return false, nil
+}
+
+// evalFilterOperand resolves a leaf of the filter expression tree: a
+// $capref against the current match, a metric lookup through a
+// builtinNode-shaped `count("name")` call, a literal, or a nested boolean
+// subexpression.
+func evalFilterOperand(n node, env *filterEnv) (string, error) {
+	switch v := n.(type) {
+	case *caprefNode:
+		return env.captures[v.name], nil
+	case *stringNode:
+		return v.text, nil
+	case *numericExprNode:
+		return strconv.FormatInt(v.value, 10), nil
+	case *filterExprNode:
+		b, err := evalFilter(v, env)
+		return strconv.FormatInt(boolToInt(b), 10), err
+	case *builtinNode:
+		return evalFilterMetric(v, env), nil
+	}
+	return "", nil
+}
+
+func evalFilterMetric(b *builtinNode, env *filterEnv) string {
+	if env.metricValue == nil || b.args == nil || len(b.args.children) == 0 {
+		return "0"
+	}
+	name, ok := b.args.children[0].(*stringNode)
+	if !ok {
+		return "0"
+	}
+	if val, ok := env.metricValue(name.text); ok {
+		return strconv.FormatInt(val, 10)
+	}
+	return "0"
+}
+
+func truthy(s string) bool {
+	return s != "" && s != "0"
+}
+
+func boolToInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
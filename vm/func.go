@@ -0,0 +1,27 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+// funcNode represents a user-defined function declaration:
+//
+//	func name(a, b) { ... }
+//
+// Unlike builtinNode, which names one of the fixed set of functions
+// implemented by the VM, funcNode is declared by the program itself. The
+// parser, symbol table and code generator do not handle funcNode; Unparser,
+// Dumper and UnparseJSON/ParseJSON do.
+type funcNode struct {
+	name   string
+	params []string
+	body   *stmtlistNode
+}
+
+// callNode represents a call to a user-defined function declared with
+// funcNode. builtinNode remains the node used for calls to VM builtins
+// such as strptime or timestamp. The parser does not produce callNode, and
+// no symbol table lookup ties a callNode's name to its funcNode.
+type callNode struct {
+	name string
+	args *exprlistNode
+}
@@ -0,0 +1,449 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/google/mtail/metrics"
+)
+
+// jsonNode is the stable on-the-wire shape for one AST node: a kind tag
+// naming the Go node type, plus whichever of the generic fields that kind
+// uses. It exists so that external tools (linters, refactoring tools,
+// language servers) can consume and emit mtail programs without linking the
+// Go parser, the way go/ast consumers lean on go/printer's text form instead
+// of the in-memory tree.
+type jsonNode struct {
+	Kind     string      `json:"kind"`
+	Children []*jsonNode `json:"children,omitempty"`
+
+	Name       string   `json:"name,omitempty"`
+	Text       string   `json:"text,omitempty"`
+	Op         string   `json:"op,omitempty"`
+	Value      *int64   `json:"value,omitempty"`
+	Keys       []string `json:"keys,omitempty"`
+	Params     []string `json:"params,omitempty"`
+	MetricKind string   `json:"metricKind,omitempty"`
+
+	Lhs    *jsonNode   `json:"lhs,omitempty"`
+	Rhs    *jsonNode   `json:"rhs,omitempty"`
+	Cond   *jsonNode   `json:"cond,omitempty"`
+	Index  *jsonNode   `json:"index,omitempty"`
+	Args   *jsonNode   `json:"args,omitempty"`
+	Body   *jsonNode   `json:"body,omitempty"`
+	Set    []*jsonNode `json:"set,omitempty"`
+	Filter *jsonNode   `json:"filter,omitempty"`
+}
+
+// UnparseJSON serializes n to the stable jsonNode schema, for consumption by
+// tooling that does not link the Go parser.
+func (u *Unparser) UnparseJSON(n node) ([]byte, error) {
+	jn, err := toJSONNode(n)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(jn, "", "  ")
+}
+
+func toJSONNode(n node) (*jsonNode, error) {
+	if n == nil {
+		return nil, nil
+	}
+	switch v := n.(type) {
+	case *stmtlistNode:
+		children, err := toJSONNodes(v.children)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonNode{Kind: "stmtlist", Children: children}, nil
+
+	case *exprlistNode:
+		children, err := toJSONNodes(v.children)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonNode{Kind: "exprlist", Children: children}, nil
+
+	case *condNode:
+		children, err := toJSONNodes(v.children)
+		if err != nil {
+			return nil, err
+		}
+		cond, err := toJSONNode(v.cond)
+		if err != nil {
+			return nil, err
+		}
+		filter, err := toJSONNode(v.filter)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonNode{Kind: "cond", Cond: cond, Filter: filter, Children: children}, nil
+
+	case *regexNode:
+		return &jsonNode{Kind: "regex", Text: v.pattern}, nil
+
+	case *binaryExprNode:
+		lhs, err := toJSONNode(v.lhs)
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := toJSONNode(v.rhs)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonNode{Kind: "binaryExpr", Op: opString(v.op), Lhs: lhs, Rhs: rhs}, nil
+
+	case *unaryExprNode:
+		lhs, err := toJSONNode(v.lhs)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonNode{Kind: "unaryExpr", Op: opString(v.op), Lhs: lhs}, nil
+
+	case *stringNode:
+		return &jsonNode{Kind: "string", Text: v.text}, nil
+
+	case *idNode:
+		return &jsonNode{Kind: "id", Name: v.name}, nil
+
+	case *caprefNode:
+		return &jsonNode{Kind: "capref", Name: v.name}, nil
+
+	case *builtinNode:
+		args, err := toJSONNode(v.args)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonNode{Kind: "builtin", Name: v.name, Args: args}, nil
+
+	case *indexedExprNode:
+		lhs, err := toJSONNode(v.lhs)
+		if err != nil {
+			return nil, err
+		}
+		index, err := toJSONNode(v.index)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonNode{Kind: "indexedExpr", Lhs: lhs, Index: index}, nil
+
+	case *declNode:
+		return &jsonNode{Kind: "decl", Name: v.name, Keys: v.keys, MetricKind: metricKindString(v.kind)}, nil
+
+	case *numericExprNode:
+		val := v.value
+		return &jsonNode{Kind: "numericExpr", Value: &val}, nil
+
+	case *defNode:
+		children, err := toJSONNodes(v.children)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonNode{Kind: "def", Name: v.name, Children: children}, nil
+
+	case *decoNode:
+		children, err := toJSONNodes(v.children)
+		if err != nil {
+			return nil, err
+		}
+		filter, err := toJSONNode(v.filter)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonNode{Kind: "deco", Name: v.name, Filter: filter, Children: children}, nil
+
+	case *nextNode:
+		return &jsonNode{Kind: "next"}, nil
+
+	case *funcNode:
+		body, err := toJSONNodes(v.body.children)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonNode{Kind: "func", Name: v.name, Params: v.params, Children: body}, nil
+
+	case *callNode:
+		args, err := toJSONNode(v.args)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonNode{Kind: "call", Name: v.name, Args: args}, nil
+
+	case *filterExprNode:
+		lhs, err := toJSONNode(v.lhs)
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := toJSONNode(v.rhs)
+		if err != nil {
+			return nil, err
+		}
+		set, err := toJSONNodes(v.set)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonNode{Kind: "filterExpr", Op: v.op.String(), Lhs: lhs, Rhs: rhs, Set: set}, nil
+	}
+	return nil, fmt.Errorf("UnparseJSON: unsupported node type %T", n)
+}
+
+func toJSONNodes(nodes []node) ([]*jsonNode, error) {
+	if nodes == nil {
+		return nil, nil
+	}
+	out := make([]*jsonNode, 0, len(nodes))
+	for _, c := range nodes {
+		jn, err := toJSONNode(c)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, jn)
+	}
+	return out, nil
+}
+
+// ParseJSON decodes data in the jsonNode schema back into an AST, the
+// reverse of UnparseJSON.
+func ParseJSON(data []byte) (node, error) {
+	var jn jsonNode
+	if err := json.Unmarshal(data, &jn); err != nil {
+		return nil, err
+	}
+	return fromJSONNode(&jn)
+}
+
+func fromJSONNode(jn *jsonNode) (node, error) {
+	if jn == nil {
+		return nil, nil
+	}
+	switch jn.Kind {
+	case "stmtlist":
+		children, err := fromJSONNodes(jn.Children)
+		if err != nil {
+			return nil, err
+		}
+		return &stmtlistNode{children: children}, nil
+
+	case "exprlist":
+		children, err := fromJSONNodes(jn.Children)
+		if err != nil {
+			return nil, err
+		}
+		return &exprlistNode{children: children}, nil
+
+	case "cond":
+		children, err := fromJSONNodes(jn.Children)
+		if err != nil {
+			return nil, err
+		}
+		cond, err := fromJSONNode(jn.Cond)
+		if err != nil {
+			return nil, err
+		}
+		filter, err := fromJSONNode(jn.Filter)
+		if err != nil {
+			return nil, err
+		}
+		fe, _ := filter.(*filterExprNode)
+		return &condNode{cond: cond, filter: fe, children: children}, nil
+
+	case "regex":
+		return &regexNode{pattern: jn.Text}, nil
+
+	case "binaryExpr":
+		lhs, err := fromJSONNode(jn.Lhs)
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := fromJSONNode(jn.Rhs)
+		if err != nil {
+			return nil, err
+		}
+		op, err := opFromString(jn.Op)
+		if err != nil {
+			return nil, err
+		}
+		return &binaryExprNode{lhs: lhs, rhs: rhs, op: op}, nil
+
+	case "unaryExpr":
+		lhs, err := fromJSONNode(jn.Lhs)
+		if err != nil {
+			return nil, err
+		}
+		op, err := opFromString(jn.Op)
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExprNode{lhs: lhs, op: op}, nil
+
+	case "string":
+		return &stringNode{text: jn.Text}, nil
+
+	case "id":
+		return &idNode{name: jn.Name}, nil
+
+	case "capref":
+		return &caprefNode{name: jn.Name}, nil
+
+	case "builtin":
+		args, err := fromJSONNode(jn.Args)
+		if err != nil {
+			return nil, err
+		}
+		el, _ := args.(*exprlistNode)
+		return &builtinNode{name: jn.Name, args: el}, nil
+
+	case "indexedExpr":
+		lhs, err := fromJSONNode(jn.Lhs)
+		if err != nil {
+			return nil, err
+		}
+		index, err := fromJSONNode(jn.Index)
+		if err != nil {
+			return nil, err
+		}
+		return &indexedExprNode{lhs: lhs, index: index}, nil
+
+	case "decl":
+		kind, err := metricKindFromString(jn.MetricKind)
+		if err != nil {
+			return nil, err
+		}
+		return &declNode{name: jn.Name, keys: jn.Keys, kind: kind}, nil
+
+	case "numericExpr":
+		if jn.Value == nil {
+			return nil, fmt.Errorf("ParseJSON: numericExpr missing value")
+		}
+		return &numericExprNode{value: *jn.Value}, nil
+
+	case "def":
+		children, err := fromJSONNodes(jn.Children)
+		if err != nil {
+			return nil, err
+		}
+		return &defNode{name: jn.Name, children: children}, nil
+
+	case "deco":
+		children, err := fromJSONNodes(jn.Children)
+		if err != nil {
+			return nil, err
+		}
+		filter, err := fromJSONNode(jn.Filter)
+		if err != nil {
+			return nil, err
+		}
+		fe, _ := filter.(*filterExprNode)
+		return &decoNode{name: jn.Name, filter: fe, children: children}, nil
+
+	case "next":
+		return &nextNode{}, nil
+
+	case "func":
+		children, err := fromJSONNodes(jn.Children)
+		if err != nil {
+			return nil, err
+		}
+		return &funcNode{name: jn.Name, params: jn.Params, body: &stmtlistNode{children: children}}, nil
+
+	case "call":
+		args, err := fromJSONNode(jn.Args)
+		if err != nil {
+			return nil, err
+		}
+		el, _ := args.(*exprlistNode)
+		return &callNode{name: jn.Name, args: el}, nil
+
+	case "filterExpr":
+		lhs, err := fromJSONNode(jn.Lhs)
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := fromJSONNode(jn.Rhs)
+		if err != nil {
+			return nil, err
+		}
+		set, err := fromJSONNodes(jn.Set)
+		if err != nil {
+			return nil, err
+		}
+		return &filterExprNode{op: filterOpFromString(jn.Op), lhs: lhs, rhs: rhs, set: set}, nil
+	}
+	return nil, fmt.Errorf("ParseJSON: unknown node kind %q", jn.Kind)
+}
+
+func fromJSONNodes(jns []*jsonNode) ([]node, error) {
+	if jns == nil {
+		return nil, nil
+	}
+	out := make([]node, 0, len(jns))
+	for _, jn := range jns {
+		n, err := fromJSONNode(jn)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+func opFromString(s string) (int, error) {
+	switch s {
+	case "<":
+		return LT, nil
+	case ">":
+		return GT, nil
+	case "<=":
+		return LE, nil
+	case ">=":
+		return GE, nil
+	case "==":
+		return EQ, nil
+	case "!=":
+		return NE, nil
+	case "<<":
+		return SHL, nil
+	case ">>":
+		return SHR, nil
+	case "&":
+		return AND, nil
+	case "|":
+		return OR, nil
+	case "^":
+		return XOR, nil
+	case "~":
+		return NOT, nil
+	case "**":
+		return POW, nil
+	case "=":
+		return ASSIGN, nil
+	case "+=":
+		return ADD_ASSIGN, nil
+	case "++":
+		return INC, nil
+	case "--":
+		return POSTDEC, nil
+	case "+", "-", "*", "/":
+		return int(s[0]), nil
+	}
+	return 0, fmt.Errorf("ParseJSON: unknown operator %q", s)
+}
+
+func metricKindFromString(s string) (metrics.Kind, error) {
+	switch s {
+	case "Counter":
+		return metrics.Counter, nil
+	case "Gauge":
+		return metrics.Gauge, nil
+	case "Timer":
+		return metrics.Timer, nil
+	}
+	return 0, fmt.Errorf("ParseJSON: unknown metric kind %q", s)
+}
+
+func filterOpFromString(s string) filterOp {
+	return filterOpFor(s)
+}
@@ -15,6 +15,13 @@ type Unparser struct {
 	pos    int
 	output string
 	line   string
+	errs   []error
+	// recurse, if set, is called instead of unparse for every child node
+	// reached while unparsing a parent. Printer sets this to its own print
+	// method so that its per-node comment and blank-line handling applies at
+	// every depth of the tree, not just to the node Unparse/Print was first
+	// called with.
+	recurse func(node)
 }
 
 func (u *Unparser) indent() {
@@ -41,32 +48,48 @@ func (u *Unparser) newline() {
 	u.line = ""
 }
 
+// visit unparses a child node reached while unparsing its parent. It is the
+// single place that distinguishes plain Unparser recursion from a subtype
+// like Printer that wants to run its own logic at every node, not just the
+// one originally passed to Unparse/Print.
+func (u *Unparser) visit(n node) {
+	if u.recurse != nil {
+		u.recurse(n)
+		return
+	}
+	u.unparse(n)
+}
+
 func (u *Unparser) unparse(n node) {
 	switch v := n.(type) {
 	case *stmtlistNode:
 		for _, child := range v.children {
-			u.unparse(child)
+			u.visit(child)
 			u.newline()
 		}
 
 	case *exprlistNode:
 		if len(v.children) > 0 {
-			u.unparse(v.children[0])
+			u.visit(v.children[0])
 			for _, child := range v.children[1:] {
 				u.emit(", ")
-				u.unparse(child)
+				u.visit(child)
 			}
 		}
 
 	case *condNode:
 		if v.cond != nil {
-			u.unparse(v.cond)
+			u.visit(v.cond)
+		}
+		if v.filter != nil {
+			u.emit(" ")
+			u.visit(v.filter)
 		}
 		u.emit(" {")
 		u.newline()
 		u.indent()
 		for _, child := range v.children {
-			u.unparse(child)
+			u.visit(child)
 		}
 		u.outdent()
 		u.emit("}")
@@ -75,7 +98,7 @@ func (u *Unparser) unparse(n node) {
 		u.emit("/" + strings.Replace(v.pattern, "/", "\\/", -1) + "/")
 
 	case *binaryExprNode:
-		u.unparse(v.lhs)
+		u.visit(v.lhs)
 		switch v.op {
 		case LT:
 			u.emit(" < ")
@@ -110,7 +133,7 @@ func (u *Unparser) unparse(n node) {
 		case ADD_ASSIGN:
 			u.emit(" += ")
 		}
-		u.unparse(v.rhs)
+		u.visit(v.rhs)
 
 	case *stringNode:
 		u.emit("\"" + v.text + "\"")
@@ -124,14 +147,14 @@ func (u *Unparser) unparse(n node) {
 	case *builtinNode:
 		u.emit(v.name + "(")
 		if v.args != nil {
-			u.unparse(v.args)
+			u.visit(v.args)
 		}
 		u.emit(")")
 
 	case *indexedExprNode:
-		u.unparse(v.lhs)
+		u.visit(v.lhs)
 		u.emit("[")
-		u.unparse(v.index)
+		u.visit(v.index)
 		u.emit("]")
 
 	case *declNode:
@@ -151,11 +174,14 @@ func (u *Unparser) unparse(n node) {
 	case *unaryExprNode:
 		switch v.op {
 		case INC:
-			u.unparse(v.lhs)
+			u.visit(v.lhs)
 			u.emit("++")
+		case POSTDEC:
+			u.visit(v.lhs)
+			u.emit("--")
 		case NOT:
-			u.emit(" ~")
-			u.unparse(v.lhs)
+			u.emit("~")
+			u.visit(v.lhs)
 		}
 
 	case *numericExprNode:
@@ -166,17 +192,22 @@ func (u *Unparser) unparse(n node) {
 		u.newline()
 		u.indent()
 		for _, child := range v.children {
-			u.unparse(child)
+			u.visit(child)
 		}
 		u.outdent()
 		u.emit("}")
 
 	case *decoNode:
-		u.emit(fmt.Sprintf("@%s {", v.name))
+		u.emit("@" + v.name)
+		if v.filter != nil {
+			u.emit(" ")
+			u.visit(v.filter)
+		}
+		u.emit(" {")
 		u.newline()
 		u.indent()
 		for _, child := range v.children {
-			u.unparse(child)
+			u.visit(child)
 		}
 		u.outdent()
 		u.emit("}")
@@ -184,8 +215,48 @@ func (u *Unparser) unparse(n node) {
 	case *nextNode:
 		u.emit("next")
 
+	case *funcNode:
+		u.emit(fmt.Sprintf("func %s(%s) {", v.name, strings.Join(v.params, ", ")))
+		u.newline()
+		u.indent()
+		for _, child := range v.body.children {
+			u.visit(child)
+		}
+		u.outdent()
+		u.emit("}")
+
+	case *callNode:
+		u.emit(v.name + "(")
+		if v.args != nil {
+			u.visit(v.args)
+		}
+		u.emit(")")
+
+	case *filterExprNode:
+		if v.op == IN_OP && v.rhs == nil {
+			u.visit(v.lhs)
+			u.emit(" in [")
+			for i, e := range v.set {
+				if i > 0 {
+					u.emit(", ")
+				}
+				u.visit(e)
+			}
+			u.emit("]")
+			break
+		}
+		if v.op == NOT_OP {
+			u.emit("!")
+			u.visit(v.lhs)
+			break
+		}
+		u.visit(v.lhs)
+		u.emit(" " + v.op.String() + " ")
+		u.visit(v.rhs)
+
 	default:
-		panic(fmt.Sprintf("unparser found undefined type %T", n))
+		u.errs = append(u.errs, fmt.Errorf("unparser found undefined type %T", n))
+		u.emit(fmt.Sprintf("/* unhandled node %T */", n))
 	}
 }
 
@@ -194,3 +265,16 @@ func (u *Unparser) Unparse(n node) string {
 	u.unparse(n)
 	return u.output
 }
+
+// UnparseErr behaves like Unparse, but also reports any node types the
+// unparser didn't know how to handle, rather than leaving them as silent
+// `/* unhandled node */` markers in the output text. Round-trip tests should
+// prefer this over Unparse so that new node kinds are caught as test
+// failures instead of passing silently.
+func (u *Unparser) UnparseErr(n node) (string, error) {
+	out := u.Unparse(n)
+	if len(u.errs) > 0 {
+		return out, fmt.Errorf("unparser: %d unhandled node type(s): %v", len(u.errs), u.errs)
+	}
+	return out, nil
+}
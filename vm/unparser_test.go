@@ -0,0 +1,164 @@
+// Copyright 2011 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"testing/quick"
+
+	"github.com/google/mtail/metrics"
+)
+
+// TestUnparseGoldenExamples parses every *.mtail program under examples/,
+// unparses it, re-parses the result, and asserts the two trees are equal.
+// This is the round-trip property the whole package relies on: any program
+// the parser accepts must survive a trip through Unparser unchanged in
+// meaning.
+func TestUnparseGoldenExamples(t *testing.T) {
+	paths, err := filepath.Glob("../examples/*.mtail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Skip("no examples/*.mtail golden files found")
+	}
+	for _, path := range paths {
+		path := path
+		t.Run(path, func(t *testing.T) {
+			src, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ast, err := Parse(path, string(src))
+			if err != nil {
+				t.Fatalf("parse: %s", err)
+			}
+			var u Unparser
+			text, err := u.UnparseErr(ast)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reparsed, err := Parse(path+" (unparsed)", text)
+			if err != nil {
+				t.Fatalf("reparse of unparsed output: %s\n---\n%s", err, text)
+			}
+			if !reflect.DeepEqual(ast, reparsed) {
+				t.Errorf("round trip changed the AST for %s\ngot:\n%s", path, text)
+			}
+		})
+	}
+}
+
+// TestUnparseRoundTripQuick generates random syntax trees and checks that
+// unparsing then reparsing produces an equal tree, using testing/quick the
+// same way the standard library tests its own encoders.
+func TestUnparseRoundTripQuick(t *testing.T) {
+	f := func(n quickNode) bool {
+		var u Unparser
+		text, err := u.UnparseErr(n.node)
+		if err != nil {
+			t.Logf("unparse error for %#v: %s", n.node, err)
+			return false
+		}
+		reparsed, err := Parse("quick", text)
+		if err != nil {
+			t.Logf("reparse error for %q: %s", text, err)
+			return false
+		}
+		return reflect.DeepEqual(n.node, reparsed)
+	}
+	cfg := &quick.Config{MaxCount: 200}
+	if err := quick.Check(f, cfg); err != nil {
+		t.Error(err)
+	}
+}
+
+// quickNode adapts the node interface to testing/quick.Generator, producing
+// small, well-formed statement lists so that generated programs are the
+// kind of thing the parser could plausibly have produced. testing/quick
+// can't generate interface values or recursive structures on its own, so
+// quickNode drives the recursion itself, capping depth with size. The mix of
+// statement kinds below covers Unparser's unary INC/POSTDEC/NOT, binary
+// arithmetic and ADD_ASSIGN, func/call, and filter expression cases, so a
+// regression in any of them shows up here rather than only in the golden
+// examples.
+type quickNode struct {
+	node node
+}
+
+func (quickNode) Generate(rnd *rand.Rand, size int) reflect.Value {
+	return reflect.ValueOf(quickNode{node: genStmtlist(rnd, size)})
+}
+
+func genStmtlist(rnd *rand.Rand, size int) *stmtlistNode {
+	n := rnd.Intn(4) + 1
+	children := make([]node, 0, n)
+	for i := 0; i < n; i++ {
+		children = append(children, genStmt(rnd, i))
+	}
+	return &stmtlistNode{children: children}
+}
+
+func genStmt(rnd *rand.Rand, i int) node {
+	switch rnd.Intn(5) {
+	case 0:
+		return genDecl(rnd, i)
+	case 1:
+		return genUnaryExpr(rnd, i)
+	case 2:
+		return genBinaryExpr(rnd, i)
+	case 3:
+		return genFunc(rnd, i)
+	default:
+		return genCond(rnd, i)
+	}
+}
+
+func genDecl(rnd *rand.Rand, i int) node {
+	kinds := []metrics.Kind{metrics.Counter, metrics.Gauge, metrics.Timer}
+	return &declNode{name: fmt.Sprintf("m%d", i), kind: kinds[rnd.Intn(len(kinds))]}
+}
+
+func genUnaryExpr(rnd *rand.Rand, i int) node {
+	ops := []int{INC, POSTDEC, NOT}
+	return &unaryExprNode{op: ops[rnd.Intn(len(ops))], lhs: &idNode{name: fmt.Sprintf("x%d", i)}}
+}
+
+func genBinaryExpr(rnd *rand.Rand, i int) node {
+	ops := []int{'+', '-', '*', '/', LT, GT, EQ, ADD_ASSIGN}
+	return &binaryExprNode{
+		op:  ops[rnd.Intn(len(ops))],
+		lhs: &idNode{name: fmt.Sprintf("x%d", i)},
+		rhs: &numericExprNode{value: int64(rnd.Intn(100))},
+	}
+}
+
+func genFunc(rnd *rand.Rand, i int) node {
+	name := fmt.Sprintf("f%d", i)
+	return &funcNode{
+		name:   name,
+		params: []string{"a", "b"},
+		body: &stmtlistNode{children: []node{
+			&callNode{name: name, args: &exprlistNode{children: []node{&numericExprNode{value: int64(rnd.Intn(10))}}}},
+		}},
+	}
+}
+
+func genCond(rnd *rand.Rand, i int) node {
+	return &condNode{
+		filter: &filterExprNode{
+			op:  EQ_OP,
+			lhs: &caprefNode{name: fmt.Sprintf("c%d", i)},
+			rhs: &numericExprNode{value: int64(rnd.Intn(10))},
+		},
+		children: []node{&nextNode{}},
+	}
+}
+
+var _ quick.Generator = quickNode{}